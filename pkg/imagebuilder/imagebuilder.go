@@ -0,0 +1,70 @@
+package imagebuilder
+
+// LayerDataSource is the type of data source used to build an image layer.
+type LayerDataSource string
+
+const (
+	// TarSource indicates that the layer data comes from an existing tar archive.
+	TarSource LayerDataSource = "tar"
+	// DirSource indicates that the layer data comes from a directory on disk.
+	DirSource LayerDataSource = "dir"
+)
+
+// LayerDataParams provides extra controls over how a layer is assembled.
+type LayerDataParams struct {
+	// TargetPath is where the layer's contents are rooted in the image
+	// filesystem (defaults to "/" when empty).
+	TargetPath string
+}
+
+// LayerDataInfo describes a single input used to build an image layer.
+type LayerDataInfo struct {
+	Type   LayerDataSource
+	Source string
+	Params *LayerDataParams
+}
+
+// SimpleBuildOptions captures the inputs needed to assemble a container
+// image without relying on a Dockerfile or a running builder.
+type SimpleBuildOptions struct {
+	From string
+
+	Layers []LayerDataInfo
+
+	Architecture string
+
+	Entrypoint []string
+	Cmd        []string
+	WorkDir    string
+	StopSignal string
+	OnBuild    []string
+	Labels     map[string]string
+	EnvVars    []string
+	User       string
+	Volumes    map[string]struct{}
+
+	ExposedPorts map[string]struct{}
+
+	Tags []string
+
+	// OCILayoutPath, when set, makes the engine also write the built image
+	// to an OCI image layout directory at this path.
+	OCILayoutPath string
+	// TarballPath, when set, makes the engine also write the built image
+	// as a Docker-save-compatible tarball at this path.
+	TarballPath string
+
+	// SquashLayers, when set, combines all of Layers into a single layer
+	// before it's added to the image, resolving whiteouts and keeping only
+	// the last occurrence of any duplicated path.
+	SquashLayers bool
+	// DedupeAcrossLayers, when set and SquashLayers is not, keeps Layers
+	// separate but drops redundant earlier copies of a path that's later
+	// overwritten with identical content.
+	DedupeAcrossLayers bool
+}
+
+// SimpleBuilder is the interface implemented by the available build engines.
+type SimpleBuilder interface {
+	Build(options SimpleBuildOptions) error
+}
@@ -0,0 +1,178 @@
+package internalbuilder
+
+import (
+	"archive/tar"
+	"bytes"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// buildTestLayer builds a v1.Layer from a simple name->content file list, in
+// the given order, so tests can exercise squashLayers/dedupeLayers without
+// touching the filesystem.
+func buildTestLayer(t *testing.T, files map[string]string, order []string) v1.Layer {
+	t.Helper()
+
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+
+	for _, name := range order {
+		content := files[name]
+		if err := tw.WriteHeader(&tar.Header{
+			Name: name,
+			Mode: 0644,
+			Size: int64(len(content)),
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	layer, err := tarball.LayerFromReader(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return layer
+}
+
+// readTestLayerNames returns the non-whiteout entry names and the whiteout
+// targets present in layer's tar stream, in encounter order.
+func readTestLayerNames(t *testing.T, layer v1.Layer) (names []string, whiteoutTargets []string) {
+	t.Helper()
+
+	order, entries, whiteouts, err := readLayerTar(layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range order {
+		if _, ok := entries[name]; ok {
+			names = append(names, name)
+		}
+	}
+
+	for _, wh := range whiteouts {
+		whiteoutTargets = append(whiteoutTargets, wh.target)
+	}
+
+	return names, whiteoutTargets
+}
+
+func TestSquashLayersKeepsLastOccurrence(t *testing.T) {
+	layer0 := buildTestLayer(t, map[string]string{"/a": "v0", "/b": "v0"}, []string{"/a", "/b"})
+	layer1 := buildTestLayer(t, map[string]string{"/a": "v1"}, []string{"/a"})
+
+	squashed, err := squashLayers([]v1.Layer{layer0, layer1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, entries, _, err := readLayerTar(squashed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(entries["/a"].data) != "v1" {
+		t.Fatalf("/a = %q, want v1 (layer1's content should win)", entries["/a"].data)
+	}
+
+	if string(entries["/b"].data) != "v0" {
+		t.Fatalf("/b = %q, want v0 (untouched by layer1)", entries["/b"].data)
+	}
+}
+
+func TestSquashLayersAppliesWhiteouts(t *testing.T) {
+	layer0 := buildTestLayer(t, map[string]string{"/a": "v0"}, []string{"/a"})
+	layer1 := buildTestLayer(t, map[string]string{".wh.a": ""}, []string{".wh.a"})
+
+	squashed, err := squashLayers([]v1.Layer{layer0, layer1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, entries, _, err := readLayerTar(squashed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, exists := entries["/a"]; exists {
+		t.Fatalf("/a should have been removed by layer1's whiteout")
+	}
+}
+
+func TestDedupeLayersDropsIdenticalEarlierCopy(t *testing.T) {
+	layer0 := buildTestLayer(t, map[string]string{"/a": "same"}, []string{"/a"})
+	layer1 := buildTestLayer(t, map[string]string{"/a": "same"}, []string{"/a"})
+
+	deduped, err := dedupeLayers([]v1.Layer{layer0, layer1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names0, _ := readTestLayerNames(t, deduped[0])
+	names1, _ := readTestLayerNames(t, deduped[1])
+
+	if len(names0) != 0 {
+		t.Fatalf("layer 0 still has %v, want the duplicate dropped since layer 1 repeats it byte-for-byte", names0)
+	}
+
+	if len(names1) != 1 || names1[0] != "/a" {
+		t.Fatalf("layer 1 = %v, want [/a] kept as the sole occurrence", names1)
+	}
+}
+
+func TestDedupeLayersWhiteoutsConsecutiveDisappearance(t *testing.T) {
+	// /a is present in layer 0, absent in layer 1, and present again in
+	// layer 2. Applying only layers 0..1 must still show /a removed, so
+	// layer 1 needs an explicit whiteout even though /a comes back later.
+	layer0 := buildTestLayer(t, map[string]string{"/a": "v0"}, []string{"/a"})
+	layer1 := buildTestLayer(t, map[string]string{}, nil)
+	layer2 := buildTestLayer(t, map[string]string{"/a": "v2"}, []string{"/a"})
+
+	deduped, err := dedupeLayers([]v1.Layer{layer0, layer1, layer2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, wh1 := readTestLayerNames(t, deduped[1])
+	found := false
+	for _, target := range wh1 {
+		if target == "/a" {
+			found = true
+		}
+	}
+
+	if !found {
+		t.Fatalf("layer 1 has no whiteout for /a, want one since /a is absent there between two layers that have it (whiteouts=%v)", wh1)
+	}
+
+	names2, _ := readTestLayerNames(t, deduped[2])
+	if len(names2) != 1 || names2[0] != "/a" {
+		t.Fatalf("layer 2 = %v, want [/a] re-added", names2)
+	}
+}
+
+func TestDedupeLayersPreservesExistingWhiteouts(t *testing.T) {
+	layer0 := buildTestLayer(t, map[string]string{"/a": "v0"}, []string{"/a"})
+	layer1 := buildTestLayer(t, map[string]string{".wh.a": ""}, []string{".wh.a"})
+
+	deduped, err := dedupeLayers([]v1.Layer{layer0, layer1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, wh1 := readTestLayerNames(t, deduped[1])
+	if len(wh1) != 1 || wh1[0] != "/a" {
+		t.Fatalf("layer 1 whiteouts = %v, want the original [.wh.a] passed through unchanged", wh1)
+	}
+}
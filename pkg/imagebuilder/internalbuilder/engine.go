@@ -3,18 +3,32 @@ package internalbuilder
 import (
 	"archive/tar"
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"os/user"
 	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/daemon"
 	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
 	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
 	"github.com/google/go-containerregistry/pkg/v1/tarball"
 	log "github.com/sirupsen/logrus"
 
@@ -26,11 +40,51 @@ const (
 	Name = "internal.container.build.engine"
 )
 
+const (
+	registryPushRetries        = 3
+	registryPushRetryBaseDelay = 1 * time.Second
+)
+
+// PushProgress reports the state of a push to a remote registry, either a
+// byte-level progress update (Completed/Total) or the tag's completion
+// (Done or Err set).
+type PushProgress struct {
+	Tag    string
+	Digest string
+
+	// Completed and Total are the compressed bytes uploaded so far and
+	// the total to upload, as reported by the registry transport.
+	Completed int64
+	Total     int64
+
+	Done bool
+	Err  error
+}
+
 // Engine is the default simple build engine
 type Engine struct {
 	ShowBuildLogs  bool
 	PushToDaemon   bool
 	PushToRegistry bool
+
+	// PushProgressChan, when set, receives a PushProgress update for each
+	// chunk of bytes uploaded while pushing to a remote registry, plus a
+	// final update (Done or Err set) per tag.
+	PushProgressChan chan<- PushProgress
+
+	// Reproducible, when set, makes dir layer tars byte-identical across
+	// hosts and invocations: entries are sorted, timestamps are normalized
+	// to SourceDateEpoch, and ownership is zeroed out.
+	Reproducible bool
+	// SourceDateEpoch is the timestamp used for normalized tar entries and
+	// the image config's Created field when Reproducible is set.
+	SourceDateEpoch time.Time
+
+	// LayerCache, when set, lets the engine reuse layers from a previous
+	// build with unchanged inputs instead of re-tarring them, and skip a
+	// build entirely (layer construction, assembly, and every output)
+	// when the full set of inputs matches a previous build's.
+	LayerCache LayerCache
 }
 
 // New creates new Engine instances
@@ -70,11 +124,31 @@ func (ref *Engine) Build(options imagebuilder.SimpleBuildOptions) error {
 	}
 
 	var img v1.Image
+	var baseCfg *v1.ConfigFile
 	if options.From == "" {
 		//same as FROM scratch
 		img = empty.Image
 	} else {
-		return fmt.Errorf("custom base images are not supported yet")
+		baseImg, err := resolveBaseImage(options.From)
+		if err != nil {
+			return fmt.Errorf("error resolving base image %s: %w", options.From, err)
+		}
+
+		baseCfg, err = baseImg.ConfigFile()
+		if err != nil {
+			return fmt.Errorf("error reading base image %s config: %w", options.From, err)
+		}
+
+		if baseCfg.OS != "" && baseCfg.OS != "linux" {
+			return fmt.Errorf("base image %s OS (%s) is not supported", options.From, baseCfg.OS)
+		}
+
+		if baseCfg.Architecture != "" && baseCfg.Architecture != options.Architecture {
+			return fmt.Errorf("base image %s architecture (%s) does not match requested architecture (%s)",
+				options.From, baseCfg.Architecture, options.Architecture)
+		}
+
+		img = baseImg
 	}
 
 	imgCfg := v1.Config{
@@ -90,14 +164,32 @@ func (ref *Engine) Build(options imagebuilder.SimpleBuildOptions) error {
 		ExposedPorts: options.ExposedPorts,
 	}
 
-	imgCfgFile := &v1.ConfigFile{
-		Created:      v1.Time{Time: time.Now()},
-		Author:       "docker-slim",
-		Config:       imgCfg,
-		Architecture: options.Architecture,
-		OS:           "linux",
+	if baseCfg != nil {
+		mergeBaseConfig(&imgCfg, baseCfg.Config)
+	}
+
+	created := time.Now()
+	if ref.Reproducible {
+		created = ref.SourceDateEpoch
 	}
 
+	// Start from the base image's config (when there is one) so its
+	// RootFS.DiffIDs and History survive mutate.ConfigFile, which replaces
+	// the whole config rather than merging into it; only the fields this
+	// build actually controls are overridden below.
+	var imgCfgFile *v1.ConfigFile
+	if baseCfg != nil {
+		imgCfgFile = baseCfg.DeepCopy()
+	} else {
+		imgCfgFile = &v1.ConfigFile{}
+	}
+
+	imgCfgFile.Created = v1.Time{Time: created}
+	imgCfgFile.Author = "docker-slim"
+	imgCfgFile.Config = imgCfg
+	imgCfgFile.Architecture = options.Architecture
+	imgCfgFile.OS = "linux"
+
 	log.Debug("DefaultSimpleBuilder.Build: config image")
 
 	img, err := mutate.ConfigFile(img, imgCfgFile)
@@ -105,6 +197,21 @@ func (ref *Engine) Build(options imagebuilder.SimpleBuildOptions) error {
 		return err
 	}
 
+	var buildKey string
+	if ref.LayerCache != nil {
+		buildKey, err = ref.buildInputKey(options, imgCfg)
+		if err != nil {
+			return fmt.Errorf("error computing build cache key: %w", err)
+		}
+
+		if manifestDigest, ok, err := ref.LayerCache.GetManifest(buildKey); err != nil {
+			log.Debugf("DefaultSimpleBuilder.Build: manifest cache lookup error: %v", err)
+		} else if ok {
+			log.Debugf("DefaultSimpleBuilder.Build: inputs unchanged, reusing previous build (manifest %s)", manifestDigest)
+			return nil
+		}
+	}
+
 	var layersToAdd []v1.Layer
 
 	for i, layerInfo := range options.Layers {
@@ -129,7 +236,7 @@ func (ref *Engine) Build(options imagebuilder.SimpleBuildOptions) error {
 				return fmt.Errorf("image layer data source path is not a tar file - %s", layerInfo.Source)
 			}
 
-			layer, err := layerFromTar(layerInfo)
+			layer, err := ref.layerFromTar(layerInfo)
 			if err != nil {
 				return err
 			}
@@ -140,7 +247,7 @@ func (ref *Engine) Build(options imagebuilder.SimpleBuildOptions) error {
 				return fmt.Errorf("image layer data source path is not a directory - %s", layerInfo.Source)
 			}
 
-			layer, err := layerFromDir(layerInfo)
+			layer, err := ref.layerFromDir(layerInfo)
 			if err != nil {
 				return err
 			}
@@ -152,7 +259,57 @@ func (ref *Engine) Build(options imagebuilder.SimpleBuildOptions) error {
 	}
 
 	log.Debug("DefaultSimpleBuilder.Build: adding layers to image")
-	newImg, err := mutate.AppendLayers(img, layersToAdd...)
+
+	var addenda []mutate.Addendum
+	switch {
+	case options.SquashLayers:
+		log.Debug("DefaultSimpleBuilder.Build: squashing layers")
+		squashed, err := squashLayers(layersToAdd)
+		if err != nil {
+			return fmt.Errorf("error squashing layers: %w", err)
+		}
+
+		addenda = []mutate.Addendum{{
+			Layer: squashed,
+			History: v1.History{
+				Author:    "docker-slim",
+				Created:   v1.Time{Time: created},
+				CreatedBy: "docker-slim: squash layers",
+			},
+		}}
+	case options.DedupeAcrossLayers:
+		log.Debug("DefaultSimpleBuilder.Build: deduping layers")
+		deduped, err := dedupeLayers(layersToAdd)
+		if err != nil {
+			return fmt.Errorf("error deduping layers: %w", err)
+		}
+
+		addenda = make([]mutate.Addendum, 0, len(deduped))
+		for i, layer := range deduped {
+			addenda = append(addenda, mutate.Addendum{
+				Layer: layer,
+				History: v1.History{
+					Author:    "docker-slim",
+					Created:   v1.Time{Time: created},
+					CreatedBy: layerHistoryCreatedBy(options.Layers[i]),
+				},
+			})
+		}
+	default:
+		addenda = make([]mutate.Addendum, 0, len(layersToAdd))
+		for i, layer := range layersToAdd {
+			addenda = append(addenda, mutate.Addendum{
+				Layer: layer,
+				History: v1.History{
+					Author:    "docker-slim",
+					Created:   v1.Time{Time: created},
+					CreatedBy: layerHistoryCreatedBy(options.Layers[i]),
+				},
+			})
+		}
+	}
+
+	newImg, err := mutate.Append(img, addenda...)
 	if err != nil {
 		return err
 	}
@@ -166,6 +323,20 @@ func (ref *Engine) Build(options imagebuilder.SimpleBuildOptions) error {
 		return err
 	}
 
+	if options.OCILayoutPath != "" {
+		log.Debugf("DefaultSimpleBuilder.Build: writing OCI image layout to %s", options.OCILayoutPath)
+		if err := writeOCILayout(options.OCILayoutPath, newImg, tag); err != nil {
+			return fmt.Errorf("error writing OCI image layout: %w", err)
+		}
+	}
+
+	if options.TarballPath != "" {
+		log.Debugf("DefaultSimpleBuilder.Build: writing tarball to %s", options.TarballPath)
+		if err := tarball.WriteToFile(options.TarballPath, tag, newImg); err != nil {
+			return fmt.Errorf("error writing image tarball: %w", err)
+		}
+	}
+
 	if ref.PushToDaemon {
 		log.Debug("DefaultSimpleBuilder.Build: saving image to Docker")
 		imageLoadResponseStr, err := daemon.Write(tag, newImg)
@@ -197,83 +368,1044 @@ func (ref *Engine) Build(options imagebuilder.SimpleBuildOptions) error {
 	}
 
 	if ref.PushToRegistry {
-		//TBD
+		log.Debug("DefaultSimpleBuilder.Build: pushing image to registry")
+		if err := ref.pushToRegistry(newImg, options.Tags); err != nil {
+			return err
+		}
+	}
+
+	// Only record the build as cached once every requested output has
+	// actually succeeded, so a failed push/write doesn't get masked as a
+	// cache hit on retry.
+	if ref.LayerCache != nil {
+		ref.recordManifestCache(buildKey, newImg)
+	}
+
+	return nil
+}
+
+// pushToRegistry pushes img to every tag, reporting progress on
+// ref.PushProgressChan (if set) and retrying transient registry errors.
+func (ref *Engine) pushToRegistry(img v1.Image, tags []string) error {
+	for _, tagName := range tags {
+		tag, err := name.NewTag(tagName)
+		if err != nil {
+			ref.notifyPushProgress(PushProgress{Tag: tagName, Err: err})
+			return err
+		}
+
+		digest, err := ref.pushImageWithRetry(img, tag)
+		if err != nil {
+			ref.notifyPushProgress(PushProgress{Tag: tagName, Err: err})
+			return fmt.Errorf("error pushing %s: %w", tagName, err)
+		}
+
+		log.Debugf("DefaultSimpleBuilder.Build: pushed %s (digest=%s)", tagName, digest)
+		ref.notifyPushProgress(PushProgress{Tag: tagName, Digest: digest, Done: true})
 	}
 
 	return nil
 }
 
-func layerFromTar(input imagebuilder.LayerDataInfo) (v1.Layer, error) {
+func (ref *Engine) notifyPushProgress(p PushProgress) {
+	if ref.PushProgressChan == nil {
+		return
+	}
+
+	ref.PushProgressChan <- p
+}
+
+// pushImageWithRetry pushes img to tag, retrying on transient registry
+// errors (429/5xx) with exponential backoff.
+func (ref *Engine) pushImageWithRetry(img v1.Image, tag name.Tag) (string, error) {
+	var lastErr error
+
+	for attempt := 0; attempt < registryPushRetries; attempt++ {
+		if attempt > 0 {
+			delay := registryPushRetryBaseDelay * time.Duration(1<<uint(attempt-1))
+			log.Debugf("DefaultSimpleBuilder.Build: retrying push to %s in %s (attempt %d)", tag.String(), delay, attempt+1)
+			time.Sleep(delay)
+		}
+
+		digest, err := ref.pushImageOnce(img, tag)
+		if err == nil {
+			return digest, nil
+		}
+
+		lastErr = err
+		if !isTransientRegistryError(err) {
+			return "", err
+		}
+	}
+
+	return "", lastErr
+}
+
+// pushImageOnce pushes img to tag a single time, streaming byte-level
+// progress to ref.PushProgressChan (if set) as the transport reports it.
+func (ref *Engine) pushImageOnce(img v1.Image, tag name.Tag) (string, error) {
+	opts := []remote.Option{remote.WithAuthFromKeychain(authn.DefaultKeychain)}
+
+	var wg sync.WaitGroup
+	if ref.PushProgressChan != nil {
+		updates := make(chan v1.Update, 16)
+		opts = append(opts, remote.WithProgress(updates))
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for u := range updates {
+				if u.Error != nil {
+					continue
+				}
+
+				ref.notifyPushProgress(PushProgress{
+					Tag:       tag.String(),
+					Completed: u.Complete,
+					Total:     u.Total,
+				})
+			}
+		}()
+	}
+
+	err := remote.Write(tag, img, opts...)
+	wg.Wait()
+	if err != nil {
+		return "", err
+	}
+
+	digest, err := img.Digest()
+	if err != nil {
+		return "", err
+	}
+
+	return digest.String(), nil
+}
+
+// isTransientRegistryError reports whether err looks like a transient
+// registry error (HTTP 429 or 5xx) worth retrying.
+func isTransientRegistryError(err error) bool {
+	var terr *transport.Error
+	if !errors.As(err, &terr) {
+		return false
+	}
+
+	return terr.StatusCode == 429 || terr.StatusCode >= 500
+}
+
+// writeOCILayout appends img to the OCI image layout directory at dir,
+// tagging it with ref. An existing layout at dir is reused (so repeated
+// builds accumulate images instead of wiping it); dir is only initialized
+// with a fresh empty index the first time.
+func writeOCILayout(dir string, img v1.Image, ref name.Tag) error {
+	path, err := layout.FromPath(dir)
+	if err != nil {
+		path, err = layout.Write(dir, empty.Index)
+		if err != nil {
+			return err
+		}
+	}
+
+	return path.AppendImage(img, layout.WithAnnotations(map[string]string{
+		"org.opencontainers.image.ref.name": ref.String(),
+	}))
+}
+
+// resolveBaseImage resolves a FROM reference to a v1.Image, trying a remote
+// registry first and falling back to the local Docker daemon.
+func resolveBaseImage(ref string) (v1.Image, error) {
+	baseRef, err := name.ParseReference(ref)
+	if err != nil {
+		return nil, fmt.Errorf("bad base image reference: %w", err)
+	}
+
+	img, rerr := remote.Image(baseRef, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+	if rerr == nil {
+		return img, nil
+	}
+
+	log.Debugf("DefaultSimpleBuilder.Build: remote.Image(%s) failed (%v), trying local daemon", ref, rerr)
+
+	img, derr := daemon.Image(baseRef)
+	if derr != nil {
+		return nil, fmt.Errorf("remote: %v, daemon: %w", rerr, derr)
+	}
+
+	return img, nil
+}
+
+// mergeBaseConfig fills in fields of cfg that are unset with the equivalent
+// values from the base image's config, with cfg (the options) taking
+// precedence for anything it already sets.
+func mergeBaseConfig(cfg *v1.Config, base v1.Config) {
+	if cfg.WorkingDir == "" {
+		cfg.WorkingDir = base.WorkingDir
+	}
+
+	if cfg.User == "" {
+		cfg.User = base.User
+	}
+
+	cfg.Env = mergeEnv(base.Env, cfg.Env)
+	cfg.Labels = mergeStringMap(base.Labels, cfg.Labels)
+	cfg.Volumes = mergeStructMap(base.Volumes, cfg.Volumes)
+	cfg.ExposedPorts = mergeStructMap(base.ExposedPorts, cfg.ExposedPorts)
+}
+
+// mergeEnv merges base "KEY=VALUE" entries with override entries, keeping
+// base ordering and letting override values win on key collisions.
+func mergeEnv(base, override []string) []string {
+	if len(base) == 0 {
+		return override
+	}
+
+	if len(override) == 0 {
+		return base
+	}
+
+	order := make([]string, 0, len(base)+len(override))
+	values := make(map[string]string, len(base)+len(override))
+
+	for _, kv := range append(append([]string{}, base...), override...) {
+		k, v := splitEnvVar(kv)
+		if _, ok := values[k]; !ok {
+			order = append(order, k)
+		}
+
+		values[k] = v
+	}
+
+	merged := make([]string, 0, len(order))
+	for _, k := range order {
+		merged = append(merged, k+"="+values[k])
+	}
+
+	return merged
+}
+
+func splitEnvVar(kv string) (string, string) {
+	if idx := strings.IndexByte(kv, '='); idx >= 0 {
+		return kv[:idx], kv[idx+1:]
+	}
+
+	return kv, ""
+}
+
+func mergeStringMap(base, override map[string]string) map[string]string {
+	if len(base) == 0 {
+		return override
+	}
+
+	merged := make(map[string]string, len(base)+len(override))
+	for k, v := range base {
+		merged[k] = v
+	}
+
+	for k, v := range override {
+		merged[k] = v
+	}
+
+	return merged
+}
+
+func mergeStructMap(base, override map[string]struct{}) map[string]struct{} {
+	if len(base) == 0 {
+		return override
+	}
+
+	merged := make(map[string]struct{}, len(base)+len(override))
+	for k := range base {
+		merged[k] = struct{}{}
+	}
+
+	for k := range override {
+		merged[k] = struct{}{}
+	}
+
+	return merged
+}
+
+// layerHistoryCreatedBy builds a docker history "created_by" string
+// describing where a layer's contents came from.
+func layerHistoryCreatedBy(layerInfo imagebuilder.LayerDataInfo) string {
+	switch layerInfo.Type {
+	case imagebuilder.TarSource:
+		return fmt.Sprintf("docker-slim: add tar layer from %s", layerInfo.Source)
+	case imagebuilder.DirSource:
+		return fmt.Sprintf("docker-slim: add dir layer from %s", layerInfo.Source)
+	default:
+		return "docker-slim: add layer"
+	}
+}
+
+// whiteoutPrefix marks a tar entry as an AUFS-style whiteout that deletes
+// the sibling path of the same name with the prefix stripped.
+const whiteoutPrefix = ".wh."
+
+// layerFileEntry is one non-whiteout path found in a layer's tar stream.
+type layerFileEntry struct {
+	header *tar.Header
+	data   []byte
+	hash   string
+}
+
+// layerWhiteout is an existing AUFS-style whiteout entry found in a
+// layer's tar stream, e.g. from a TarSource layer that already carries a
+// deletion from an earlier build step.
+type layerWhiteout struct {
+	header *tar.Header
+	target string
+}
+
+// readLayerTar reads layer's uncompressed tar stream into an ordered list
+// of non-whiteout file entries and the existing whiteout entries it
+// carries, in the order they're encountered.
+func readLayerTar(layer v1.Layer) (order []string, entries map[string]layerFileEntry, whiteouts []layerWhiteout, err error) {
+	rc, err := layer.Uncompressed()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer rc.Close()
+
+	entries = map[string]layerFileEntry{}
+
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to read layer tar: %w", err)
+		}
+
+		name := path.Clean("/" + hdr.Name)
+		base := path.Base(name)
+
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			hc := *hdr
+			whiteouts = append(whiteouts, layerWhiteout{
+				header: &hc,
+				target: path.Join(path.Dir(name), strings.TrimPrefix(base, whiteoutPrefix)),
+			})
+			continue
+		}
+
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to read layer tar entry %s: %w", hdr.Name, err)
+		}
+
+		if _, exists := entries[name]; !exists {
+			order = append(order, name)
+		}
+
+		hc := *hdr
+		sum := sha256.Sum256(content)
+		entries[name] = layerFileEntry{header: &hc, data: content, hash: hex.EncodeToString(sum[:])}
+	}
+
+	return order, entries, whiteouts, nil
+}
+
+// squashLayers combines layers into a single layer, resolving whiteouts
+// and keeping only the last occurrence of any duplicated path.
+func squashLayers(layers []v1.Layer) (v1.Layer, error) {
+	var order []string
+	inOrder := map[string]bool{}
+	merged := map[string]layerFileEntry{}
+
+	for i, layer := range layers {
+		layerOrder, entries, whiteouts, err := readLayerTar(layer)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read layer %d: %w", i, err)
+		}
+
+		for _, wh := range whiteouts {
+			delete(merged, wh.target)
+			for name := range merged {
+				if strings.HasPrefix(name, wh.target+"/") {
+					delete(merged, name)
+				}
+			}
+		}
+
+		for _, name := range layerOrder {
+			if !inOrder[name] {
+				inOrder[name] = true
+				order = append(order, name)
+			}
+
+			merged[name] = entries[name]
+		}
+	}
+
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+
+	for _, name := range order {
+		e, ok := merged[name]
+		if !ok {
+			// removed by a later whiteout
+			continue
+		}
+
+		if err := tw.WriteHeader(e.header); err != nil {
+			return nil, fmt.Errorf("failed to write squashed tar header: %w", err)
+		}
+
+		if len(e.data) > 0 {
+			if _, err := tw.Write(e.data); err != nil {
+				return nil, fmt.Errorf("failed to write squashed tar data: %w", err)
+			}
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to finish squashed tar: %w", err)
+	}
+
+	return tarball.LayerFromReader(&b)
+}
+
+// dedupeLayers keeps layers separate but drops an earlier occurrence of a
+// path when the last layer that carries the path has byte-identical content
+// for it (copies that differ from that last one are kept), and
+// whites out a path at every layer where it disappears, even if it
+// reappears afterwards, since docker-slim's layers are full snapshots
+// rather than diffs.
+func dedupeLayers(layers []v1.Layer) ([]v1.Layer, error) {
+	orders := make([][]string, len(layers))
+	contents := make([]map[string]layerFileEntry, len(layers))
+	existingWhiteouts := make([][]layerWhiteout, len(layers))
+
+	for i, layer := range layers {
+		order, entries, whiteouts, err := readLayerTar(layer)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read layer %d: %w", i, err)
+		}
+
+		orders[i] = order
+		contents[i] = entries
+		existingWhiteouts[i] = whiteouts
+	}
+
+	lastIndex := map[string]int{}
+	allPaths := map[string]bool{}
+	for i, order := range orders {
+		for _, name := range order {
+			lastIndex[name] = i
+			allPaths[name] = true
+		}
+	}
+
+	existingWhiteoutTargets := make([]map[string]bool, len(layers))
+	for i, whiteouts := range existingWhiteouts {
+		existingWhiteoutTargets[i] = map[string]bool{}
+		for _, wh := range whiteouts {
+			existingWhiteoutTargets[i][wh.target] = true
+		}
+	}
+
+	// A path needs a whiteout at i+1 whenever it's present in layer i and
+	// absent from layer i+1, even if it reappears in a later layer: each
+	// layer is a full snapshot, so the gap at i+1 must be made explicit
+	// or the path would incorrectly look untouched there.
+	removedAfter := make([][]string, len(layers))
+	for name := range allPaths {
+		for i := 0; i < len(layers)-1; i++ {
+			_, presentHere := contents[i][name]
+			_, presentNext := contents[i+1][name]
+
+			if presentHere && !presentNext && !existingWhiteoutTargets[i+1][name] {
+				removedAfter[i+1] = append(removedAfter[i+1], name)
+			}
+		}
+	}
+
+	for i := range removedAfter {
+		sort.Strings(removedAfter[i])
+	}
+
+	deduped := make([]v1.Layer, len(layers))
+	for i := range layers {
+		var b bytes.Buffer
+		tw := tar.NewWriter(&b)
+
+		for _, name := range orders[i] {
+			e := contents[i][name]
+			if last := lastIndex[name]; last != i && e.hash == contents[last][name].hash {
+				continue
+			}
+
+			if err := tw.WriteHeader(e.header); err != nil {
+				return nil, fmt.Errorf("failed to write deduped tar header: %w", err)
+			}
+
+			if len(e.data) > 0 {
+				if _, err := tw.Write(e.data); err != nil {
+					return nil, fmt.Errorf("failed to write deduped tar data: %w", err)
+				}
+			}
+		}
+
+		for _, wh := range existingWhiteouts[i] {
+			if err := tw.WriteHeader(wh.header); err != nil {
+				return nil, fmt.Errorf("failed to write existing whiteout header: %w", err)
+			}
+		}
+
+		for _, name := range removedAfter[i] {
+			if err := tw.WriteHeader(&tar.Header{
+				Name: path.Join(path.Dir(name), whiteoutPrefix+path.Base(name)),
+				Size: 0,
+				Mode: 0644,
+			}); err != nil {
+				return nil, fmt.Errorf("failed to write whiteout header: %w", err)
+			}
+		}
+
+		if err := tw.Close(); err != nil {
+			return nil, fmt.Errorf("failed to finish deduped tar %d: %w", i, err)
+		}
+
+		layer, err := tarball.LayerFromReader(&b)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build deduped layer %d: %w", i, err)
+		}
+
+		deduped[i] = layer
+	}
+
+	return deduped, nil
+}
+
+func (ref *Engine) layerFromTar(input imagebuilder.LayerDataInfo) (v1.Layer, error) {
 	if !fsutil.Exists(input.Source) ||
 		!fsutil.IsRegularFile(input.Source) {
 		return nil, fmt.Errorf("bad input data")
 	}
 
-	return tarball.LayerFromFile(input.Source)
+	if ref.LayerCache == nil {
+		return tarball.LayerFromFile(input.Source)
+	}
+
+	key, err := hashFile(input.Source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash tar layer source: %w", err)
+	}
+
+	if layer, ok, err := ref.LayerCache.GetLayer(key); err != nil {
+		log.Debugf("DefaultSimpleBuilder.Build: layer cache lookup error for %s: %v", input.Source, err)
+	} else if ok {
+		log.Debugf("DefaultSimpleBuilder.Build: layer cache hit for %s", input.Source)
+		return layer, nil
+	}
+
+	layer, err := tarball.LayerFromFile(input.Source)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ref.LayerCache.PutLayer(key, layer); err != nil {
+		log.Debugf("DefaultSimpleBuilder.Build: layer cache store error for %s: %v", input.Source, err)
+	}
+
+	return layer, nil
+}
+
+// buildInputKey derives a cache key for the whole build from everything
+// that determines its output: the resolved image config, the build flags
+// that affect assembly, the requested outputs, and each layer's own cache
+// key. It's computed before any layer is tarred so a hit in
+// ref.LayerCache.GetManifest lets Build return early without doing that
+// work.
+func (ref *Engine) buildInputKey(options imagebuilder.SimpleBuildOptions, imgCfg v1.Config) (string, error) {
+	cfgBytes, err := json.Marshal(imgCfg)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode image config: %w", err)
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "from=%s\narch=%s\n", options.From, options.Architecture)
+	fmt.Fprintf(h, "reproducible=%v\nsourceDateEpoch=%d\n", ref.Reproducible, ref.SourceDateEpoch.UnixNano())
+	fmt.Fprintf(h, "squash=%v\ndedupe=%v\n", options.SquashLayers, options.DedupeAcrossLayers)
+	fmt.Fprintf(h, "pushToDaemon=%v\npushToRegistry=%v\n", ref.PushToDaemon, ref.PushToRegistry)
+	fmt.Fprintf(h, "ociLayout=%s\ntarball=%s\n", options.OCILayoutPath, options.TarballPath)
+	fmt.Fprintf(h, "tags=%s\n", strings.Join(options.Tags, ","))
+	h.Write(cfgBytes)
+
+	for _, layerInfo := range options.Layers {
+		var key string
+		var err error
+
+		switch layerInfo.Type {
+		case imagebuilder.TarSource:
+			key, err = hashFile(layerInfo.Source)
+		case imagebuilder.DirSource:
+			key, err = ref.dirCacheKey(layerInfo)
+		default:
+			return "", fmt.Errorf("unknown image data source - %v", layerInfo.Source)
+		}
+
+		if err != nil {
+			return "", fmt.Errorf("failed to key layer %s: %w", layerInfo.Source, err)
+		}
+
+		fmt.Fprintf(h, "layer:%s:%s\n", layerInfo.Type, key)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
-func layerFromDir(input imagebuilder.LayerDataInfo) (v1.Layer, error) {
+// recordManifestCache stores img's manifest digest under buildKey so a
+// future build with the same inputs can be recognized by buildInputKey
+// and skipped entirely.
+func (ref *Engine) recordManifestCache(buildKey string, img v1.Image) {
+	manifestDigest, err := img.Digest()
+	if err != nil {
+		log.Debugf("DefaultSimpleBuilder.Build: error computing image manifest digest: %v", err)
+		return
+	}
+
+	if err := ref.LayerCache.PutManifest(buildKey, manifestDigest.String()); err != nil {
+		log.Debugf("DefaultSimpleBuilder.Build: manifest cache store error: %v", err)
+	}
+}
+
+// hashFile returns the hex-encoded sha256 of the file at p.
+func hashFile(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// dirEntry is one file (or synthetic parent directory) that will become a
+// tar entry in a dir-sourced layer.
+type dirEntry struct {
+	archivePath string
+	fsPath      string
+	// info is nil for synthetic parent directory entries that don't
+	// correspond to a path under the source directory.
+	info os.FileInfo
+}
+
+func (ref *Engine) layerFromDir(input imagebuilder.LayerDataInfo) (v1.Layer, error) {
 	if !fsutil.Exists(input.Source) ||
 		!fsutil.IsDir(input.Source) {
 		return nil, fmt.Errorf("bad input data")
 	}
 
-	var b bytes.Buffer
-	tw := tar.NewWriter(&b)
+	if ref.LayerCache == nil {
+		return ref.buildDirLayer(input)
+	}
+
+	key, err := ref.dirCacheKey(input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute layer cache key for %s: %w", input.Source, err)
+	}
+
+	if layer, ok, err := ref.LayerCache.GetLayer(key); err != nil {
+		log.Debugf("DefaultSimpleBuilder.Build: layer cache lookup error for %s: %v", input.Source, err)
+	} else if ok {
+		log.Debugf("DefaultSimpleBuilder.Build: layer cache hit for %s", input.Source)
+		return layer, nil
+	}
 
+	layer, err := ref.buildDirLayer(input)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ref.LayerCache.PutLayer(key, layer); err != nil {
+		log.Debugf("DefaultSimpleBuilder.Build: layer cache store error for %s: %v", input.Source, err)
+	}
+
+	return layer, nil
+}
+
+// dirCacheKey derives a content-addressable cache key for a DirSource
+// layer from its sorted file list, per-file mtimes (or content hashes when
+// Reproducible is set, since mtimes are normalized away), TargetPath, and
+// the uid/gid policy in effect.
+func (ref *Engine) dirCacheKey(input imagebuilder.LayerDataInfo) (string, error) {
 	layerBasePath := "/"
 	if input.Params != nil && input.Params.TargetPath != "" {
 		layerBasePath = input.Params.TargetPath
 	}
 
+	type fileStamp struct {
+		rel   string
+		stamp string
+	}
+
+	var stamps []fileStamp
+
 	err := filepath.Walk(input.Source, func(fp string, info os.FileInfo, err error) error {
 		if err != nil {
 			return nil
 		}
+
 		rel, err := filepath.Rel(input.Source, fp)
 		if err != nil {
-			return fmt.Errorf("failed to calculate relative path: %w", err)
+			return err
 		}
 
-		hdr := &tar.Header{
-			Name: path.Join(layerBasePath, filepath.ToSlash(rel)),
-			Mode: int64(info.Mode()),
+		if rel == "." {
+			return nil
 		}
 
-		if !info.IsDir() {
-			hdr.Size = info.Size()
+		stamp := fmt.Sprintf("%d", info.ModTime().UnixNano())
+		if ref.Reproducible && info.Mode().IsRegular() {
+			stamp, err = hashFile(fp)
+			if err != nil {
+				return err
+			}
 		}
 
-		if info.Mode().IsDir() {
-			hdr.Typeflag = tar.TypeDir
-		} else if info.Mode().IsRegular() {
-			hdr.Typeflag = tar.TypeReg
-		} else {
-			return fmt.Errorf("not implemented archiving file type %s (%s)", info.Mode(), rel)
+		stamps = append(stamps, fileStamp{rel: rel, stamp: stamp})
+
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to scan files: %w", err)
+	}
+
+	sort.Slice(stamps, func(i, j int) bool { return stamps[i].rel < stamps[j].rel })
+
+	h := sha256.New()
+	fmt.Fprintf(h, "target=%s\nreproducible=%v\n", layerBasePath, ref.Reproducible)
+
+	for _, s := range stamps {
+		fmt.Fprintf(h, "%s %s\n", s.rel, s.stamp)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// buildDirLayer tars up input.Source into a new layer.
+func (ref *Engine) buildDirLayer(input imagebuilder.LayerDataInfo) (v1.Layer, error) {
+	layerBasePath := "/"
+	if input.Params != nil && input.Params.TargetPath != "" {
+		layerBasePath = input.Params.TargetPath
+	}
+
+	entries, err := ref.collectDirEntries(input.Source, layerBasePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+
+	hardlinks := map[[2]uint64]string{}
+
+	for _, e := range entries {
+		hdr, err := ref.tarHeaderFor(e, hardlinks)
+		if err != nil {
+			return nil, err
 		}
 
 		if err := tw.WriteHeader(hdr); err != nil {
-			return fmt.Errorf("failed to write tar header: %w", err)
+			return nil, fmt.Errorf("failed to write tar header: %w", err)
 		}
-		if !info.IsDir() {
-			f, err := os.Open(fp)
+
+		if hdr.Typeflag == tar.TypeReg {
+			f, err := os.Open(e.fsPath)
 			if err != nil {
-				return err
-			}
-			if _, err := io.Copy(tw, f); err != nil {
-				return fmt.Errorf("failed to read file into the tar: %w", err)
+				return nil, err
 			}
+
+			_, err = io.Copy(tw, f)
 			f.Close()
+			if err != nil {
+				return nil, fmt.Errorf("failed to read file into the tar: %w", err)
+			}
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to finish tar: %w", err)
+	}
+
+	return tarball.LayerFromReader(&b)
+}
+
+// collectDirEntries walks source and returns the tar entries for its
+// contents, rooted at layerBasePath, including an entry for layerBasePath
+// itself. When ref.Reproducible is set, entries are sorted by archive path
+// and synthetic entries are added for layerBasePath's parent directories,
+// so the resulting tar is independent of filesystem walk order and can be
+// applied on its own.
+func (ref *Engine) collectDirEntries(source, layerBasePath string) ([]dirEntry, error) {
+	var entries []dirEntry
+
+	if ref.Reproducible {
+		entries = append(entries, syntheticParentDirs(layerBasePath)...)
+	}
+
+	err := filepath.Walk(source, func(fp string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
 		}
+
+		rel, err := filepath.Rel(source, fp)
+		if err != nil {
+			return fmt.Errorf("failed to calculate relative path: %w", err)
+		}
+
+		entries = append(entries, dirEntry{
+			archivePath: path.Join(layerBasePath, filepath.ToSlash(rel)),
+			fsPath:      fp,
+			info:        info,
+		})
+
 		return nil
 	})
 
 	if err != nil {
 		return nil, fmt.Errorf("failed to scan files: %w", err)
 	}
-	if err := tw.Close(); err != nil {
-		return nil, fmt.Errorf("failed to finish tar: %w", err)
+
+	if ref.Reproducible {
+		sort.Slice(entries, func(i, j int) bool { return entries[i].archivePath < entries[j].archivePath })
 	}
 
-	return tarball.LayerFromReader(&b)
+	return entries, nil
+}
+
+// syntheticParentDirs returns a directory entry for every path component
+// strictly above layerBasePath, so a layer rooted below "/" (e.g.
+// "/usr/local/bin") still contains its ancestor directories. layerBasePath
+// itself is left out: the walk over source always emits its own entry for
+// the root ("." relative to source), so adding one here would duplicate it.
+func syntheticParentDirs(layerBasePath string) []dirEntry {
+	clean := path.Clean("/" + layerBasePath)
+	if clean == "/" {
+		return nil
+	}
+
+	parts := strings.Split(strings.Trim(clean, "/"), "/")
+	if len(parts) < 2 {
+		return nil
+	}
+
+	var entries []dirEntry
+	cur := "/"
+	for _, p := range parts[:len(parts)-1] {
+		cur = path.Join(cur, p)
+		entries = append(entries, dirEntry{archivePath: cur})
+	}
+
+	return entries
+}
+
+// tarHeaderFor builds the tar.Header for e, resolving hardlinks against
+// previously seen (dev, ino) pairs in hardlinks and normalizing metadata
+// when ref.Reproducible is set.
+func (ref *Engine) tarHeaderFor(e dirEntry, hardlinks map[[2]uint64]string) (*tar.Header, error) {
+	if e.info == nil {
+		hdr := &tar.Header{
+			Name:     e.archivePath,
+			Typeflag: tar.TypeDir,
+			Mode:     0755,
+		}
+
+		ref.normalizeHeader(hdr)
+		return hdr, nil
+	}
+
+	info := e.info
+	hdr := &tar.Header{
+		Name: e.archivePath,
+		Mode: int64(info.Mode()),
+	}
+
+	if !info.IsDir() {
+		hdr.Size = info.Size()
+	}
+
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		linkname, err := os.Readlink(e.fsPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read symlink %s: %w", e.archivePath, err)
+		}
+
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Linkname = linkname
+		hdr.Size = 0
+	case info.Mode().IsDir():
+		hdr.Typeflag = tar.TypeDir
+	case info.Mode().IsRegular():
+		hdr.Typeflag = tar.TypeReg
+
+		if st, ok := info.Sys().(*syscall.Stat_t); ok && st.Nlink > 1 {
+			key := [2]uint64{uint64(st.Dev), st.Ino}
+			if target, seen := hardlinks[key]; seen {
+				hdr.Typeflag = tar.TypeLink
+				hdr.Linkname = target
+				hdr.Size = 0
+			} else {
+				hardlinks[key] = e.archivePath
+			}
+		}
+
+		xattrs, err := readXattrs(e.fsPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read xattrs for %s: %w", e.archivePath, err)
+		}
+
+		for name, value := range xattrs {
+			if hdr.PAXRecords == nil {
+				hdr.PAXRecords = map[string]string{}
+			}
+
+			hdr.PAXRecords["SCHILY.xattr."+name] = value
+		}
+	case info.Mode()&os.ModeNamedPipe != 0:
+		hdr.Typeflag = tar.TypeFifo
+		hdr.Size = 0
+	case info.Mode()&os.ModeDevice != 0:
+		st, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return nil, fmt.Errorf("unable to read device info for %s", e.archivePath)
+		}
+
+		hdr.Devmajor, hdr.Devminor = deviceMajorMinor(uint64(st.Rdev))
+		hdr.Size = 0
+
+		if info.Mode()&os.ModeCharDevice != 0 {
+			hdr.Typeflag = tar.TypeChar
+		} else {
+			hdr.Typeflag = tar.TypeBlock
+		}
+	default:
+		return nil, fmt.Errorf("not implemented archiving file type %s (%s)", info.Mode(), e.archivePath)
+	}
+
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		hdr.Uid = int(st.Uid)
+		hdr.Gid = int(st.Gid)
+
+		if !ref.Reproducible {
+			if u, err := user.LookupId(strconv.Itoa(hdr.Uid)); err == nil {
+				hdr.Uname = u.Username
+			}
+
+			if g, err := user.LookupGroupId(strconv.Itoa(hdr.Gid)); err == nil {
+				hdr.Gname = g.Name
+			}
+		}
+	}
+
+	if !ref.Reproducible {
+		hdr.ModTime = info.ModTime()
+	}
+
+	ref.normalizeHeader(hdr)
+
+	return hdr, nil
+}
+
+// deviceMajorMinor splits a Linux dev_t into its major/minor components
+// (see gnu_dev_major/gnu_dev_minor in glibc's sysmacros.h).
+func deviceMajorMinor(rdev uint64) (int64, int64) {
+	major := (rdev >> 8) & 0xfff
+	major |= (rdev >> 32) & 0xfffff000
+
+	minor := rdev & 0xff
+	minor |= (rdev >> 12) & 0xffffff00
+
+	return int64(major), int64(minor)
+}
+
+// readXattrs reads all extended attributes of the file at fp, returning
+// nil if the filesystem doesn't support them.
+func readXattrs(fp string) (map[string]string, error) {
+	size, err := syscall.Listxattr(fp, nil)
+	if err != nil {
+		if errors.Is(err, syscall.ENOTSUP) || errors.Is(err, syscall.EOPNOTSUPP) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	if size == 0 {
+		return nil, nil
+	}
+
+	buf := make([]byte, size)
+	n, err := syscall.Listxattr(fp, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	xattrs := map[string]string{}
+	for _, name := range splitXattrNames(buf[:n]) {
+		vsize, err := syscall.Getxattr(fp, name, nil)
+		if err != nil || vsize == 0 {
+			continue
+		}
+
+		value := make([]byte, vsize)
+		vn, err := syscall.Getxattr(fp, name, value)
+		if err != nil {
+			continue
+		}
+
+		xattrs[name] = string(value[:vn])
+	}
+
+	return xattrs, nil
+}
+
+// splitXattrNames splits the NUL-separated name list returned by
+// syscall.Listxattr.
+func splitXattrNames(buf []byte) []string {
+	var names []string
+
+	start := 0
+	for i, b := range buf {
+		if b != 0 {
+			continue
+		}
+
+		if i > start {
+			names = append(names, string(buf[start:i]))
+		}
+
+		start = i + 1
+	}
+
+	return names
+}
+
+// normalizeHeader, when ref.Reproducible is set, sets hdr's timestamps to
+// ref.SourceDateEpoch and clears its ownership, the metadata that would
+// otherwise make a tar entry depend on the host or the time it was built.
+// When ref.Reproducible is not set it leaves hdr unchanged.
+func (ref *Engine) normalizeHeader(hdr *tar.Header) {
+	if !ref.Reproducible {
+		return
+	}
+
+	hdr.ModTime = ref.SourceDateEpoch
+	hdr.AccessTime = ref.SourceDateEpoch
+	hdr.ChangeTime = ref.SourceDateEpoch
+	hdr.Uid = 0
+	hdr.Gid = 0
+	hdr.Uname = ""
+	hdr.Gname = ""
 }
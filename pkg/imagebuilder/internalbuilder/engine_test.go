@@ -0,0 +1,97 @@
+package internalbuilder
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSyntheticParentDirsExcludesBasePathItself(t *testing.T) {
+	entries := syntheticParentDirs("/usr/local/bin")
+
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.archivePath)
+	}
+
+	want := []string{"/usr", "/usr/local"}
+	if len(got) != len(want) {
+		t.Fatalf("syntheticParentDirs(/usr/local/bin) = %v, want %v", got, want)
+	}
+
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("syntheticParentDirs(/usr/local/bin) = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestSyntheticParentDirsRoot(t *testing.T) {
+	if entries := syntheticParentDirs("/"); entries != nil {
+		t.Fatalf("syntheticParentDirs(/) = %v, want nil", entries)
+	}
+
+	if entries := syntheticParentDirs("/app"); entries != nil {
+		t.Fatalf("syntheticParentDirs(/app) = %v, want nil (no ancestors above /app)", entries)
+	}
+}
+
+func TestCollectDirEntriesIncludesOwnRootEntry(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "file.txt"), []byte("hi"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ref := &Engine{}
+	entries, err := ref.collectDirEntries(dir, "/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var rootEntries int
+	var fileFound bool
+	for _, e := range entries {
+		if e.archivePath == "/app" {
+			rootEntries++
+			if e.info == nil {
+				t.Fatalf("root entry for /app has no fs info, want the source directory's real stat")
+			}
+		}
+
+		if e.archivePath == "/app/file.txt" {
+			fileFound = true
+		}
+	}
+
+	if rootEntries != 1 {
+		t.Fatalf("got %d entries for /app, want exactly 1", rootEntries)
+	}
+
+	if !fileFound {
+		t.Fatalf("missing entry for /app/file.txt in %v", entries)
+	}
+}
+
+func TestCollectDirEntriesReproducibleNoDuplicateRoot(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "file.txt"), []byte("hi"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ref := &Engine{Reproducible: true}
+	entries, err := ref.collectDirEntries(dir, "/usr/local/bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counts := map[string]int{}
+	for _, e := range entries {
+		counts[e.archivePath]++
+	}
+
+	for _, p := range []string{"/usr", "/usr/local", "/usr/local/bin", "/usr/local/bin/file.txt"} {
+		if counts[p] != 1 {
+			t.Fatalf("archivePath %s appears %d times, want 1 (entries=%v)", p, counts[p], entries)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package internalbuilder
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+const defaultLayerCacheDirName = ".docker-slim/layer-cache"
+
+// LayerCache resolves and stores content-addressed image layers and
+// manifests so repeated builds with unchanged inputs can skip re-tarring
+// and re-assembling them.
+type LayerCache interface {
+	// GetLayer returns the cached layer for key, with ok false on a miss.
+	GetLayer(key string) (layer v1.Layer, ok bool, err error)
+	// PutLayer stores layer under key for future reuse.
+	PutLayer(key string, layer v1.Layer) error
+
+	// GetManifest returns the cached manifest digest produced by a
+	// previous build with the given build input key (see
+	// Engine.buildInputKey), with ok false on a miss. A hit means the
+	// build can be skipped entirely.
+	GetManifest(buildKey string) (manifestDigest string, ok bool, err error)
+	// PutManifest records manifestDigest as the result of building the
+	// inputs identified by buildKey.
+	PutManifest(buildKey string, manifestDigest string) error
+}
+
+// FSLayerCache is a filesystem-backed LayerCache that stores layer
+// tarballs as <BaseDir>/<key>.tar.gz and manifest digests as small files
+// under <BaseDir>/manifests.
+type FSLayerCache struct {
+	BaseDir string
+}
+
+// NewFSLayerCache creates a FSLayerCache rooted at baseDir, creating it if
+// needed. An empty baseDir defaults to ~/.docker-slim/layer-cache.
+func NewFSLayerCache(baseDir string) (*FSLayerCache, error) {
+	if baseDir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("error resolving home directory: %w", err)
+		}
+
+		baseDir = filepath.Join(home, defaultLayerCacheDirName)
+	}
+
+	if err := os.MkdirAll(baseDir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating layer cache dir: %w", err)
+	}
+
+	return &FSLayerCache{BaseDir: baseDir}, nil
+}
+
+func (c *FSLayerCache) layerPath(key string) string {
+	return filepath.Join(c.BaseDir, key+".tar.gz")
+}
+
+func (c *FSLayerCache) manifestPath(buildKey string) string {
+	return filepath.Join(c.BaseDir, "manifests", buildKey+".manifest")
+}
+
+// GetLayer implements LayerCache.
+func (c *FSLayerCache) GetLayer(key string) (v1.Layer, bool, error) {
+	p := c.layerPath(key)
+
+	if _, err := os.Stat(p); errors.Is(err, os.ErrNotExist) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	layer, err := tarball.LayerFromFile(p)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return layer, true, nil
+}
+
+// PutLayer implements LayerCache.
+func (c *FSLayerCache) PutLayer(key string, layer v1.Layer) error {
+	rc, err := layer.Compressed()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	p := c.layerPath(key)
+	tmp := p + ".tmp"
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(f, rc); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("error writing cached layer: %w", err)
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, p)
+}
+
+// GetManifest implements LayerCache.
+func (c *FSLayerCache) GetManifest(buildKey string) (string, bool, error) {
+	data, err := os.ReadFile(c.manifestPath(buildKey))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+
+	return strings.TrimSpace(string(data)), true, nil
+}
+
+// PutManifest implements LayerCache.
+func (c *FSLayerCache) PutManifest(buildKey, manifestDigest string) error {
+	p := c.manifestPath(buildKey)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+
+	return os.WriteFile(p, []byte(manifestDigest), 0644)
+}